@@ -2,8 +2,13 @@ package sources
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"io"
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
 
 	"github.com/trufflesecurity/trufflehog/v3/pkg/context"
 )
@@ -34,6 +39,46 @@ type chunkReaderConfig struct {
 	// computations downstream from operating on a larger-than-needed chunk.
 	// It's expressed as a value between 0 and 1.
 	smallChunkThreshold int
+
+	// cdc holds the content-defined chunking settings. It's zero-valued
+	// (disabled) unless WithContentDefinedChunking is used.
+	cdc cdcOptions
+
+	// boundaryFunc, if set, retreats each chunk's cut point to the last
+	// safe position it reports. It's nil (disabled) unless
+	// WithBoundaryFunc is used.
+	boundaryFunc BoundaryFunc
+
+	// maxExpansionRatio and maxBytes bound how much downstream work a
+	// chunk pipeline can produce from a given input. Zero disables the
+	// respective check.
+	maxExpansionRatio float64
+	maxBytes          int64
+}
+
+// cdcOptions configures content-defined chunking, an alternative to the
+// default fixed-size cuts that selects chunk boundaries based on the
+// content itself, so that a small edit upstream only reshuffles the
+// chunk(s) around the edit instead of every chunk that follows it.
+type cdcOptions struct {
+	enabled bool
+	minSize int
+	avgSize int
+	maxSize int
+}
+
+// WithContentDefinedChunking enables content-defined chunking using a
+// rolling Rabin fingerprint instead of the default fixed ChunkSize cut.
+// Boundaries are chosen so that, on average, chunks are avgSize bytes
+// long, never smaller than minSize, and never larger than maxSize. This
+// is useful when re-scanning slightly modified blobs (git objects,
+// rotating log files, tar members): inserting or removing a few bytes
+// only shifts the chunk(s) containing the edit, so unaffected chunks
+// keep the same content hash and don't need to be re-scanned.
+func WithContentDefinedChunking(minSize, avgSize, maxSize int) ConfigOption {
+	return func(c *chunkReaderConfig) {
+		c.cdc = cdcOptions{enabled: true, minSize: minSize, avgSize: avgSize, maxSize: maxSize}
+	}
 }
 
 // ConfigOption is a function that configures a chunker.
@@ -49,11 +94,178 @@ func WithPeekSize(size int) ConfigOption {
 	return func(c *chunkReaderConfig) { c.peekSize = size }
 }
 
+// boundaryLookback bounds how far back from a proposed chunk boundary a
+// BoundaryFunc is allowed to retreat the cut.
+const boundaryLookback = 512
+
+// BoundaryFunc inspects tail, the last boundaryLookback bytes up to a
+// proposed chunk boundary, and returns the index within tail after which
+// it's safe to cut, or -1 if no safe position exists within tail.
+type BoundaryFunc func(tail []byte) int
+
+// WithBoundaryFunc retreats a chunk's cut point from the default fixed
+// offset back to the last "safe" position reported by fn, within a
+// bounded lookback window. This stops detectors from missing (or
+// double-reporting) secrets that would otherwise straddle a chunk
+// boundary: the bytes between the safe position and the original cut are
+// pushed back so they start the next chunk instead of this one.
+func WithBoundaryFunc(fn BoundaryFunc) ConfigOption {
+	return func(c *chunkReaderConfig) { c.boundaryFunc = fn }
+}
+
+// LineBoundary retreats a cut to the last newline within tail, so a
+// chunk doesn't split a line in two. If tail has no newline it returns -1
+// and the cut stays where it was.
+func LineBoundary(tail []byte) int {
+	return bytes.LastIndexByte(tail, '\n')
+}
+
+// WhitespaceBoundary retreats a cut to the last whitespace byte within
+// tail, so a chunk doesn't split a whitespace-delimited token in two. If
+// tail has no whitespace it returns -1 and the cut stays where it was.
+func WhitespaceBoundary(tail []byte) int {
+	return bytes.LastIndexAny(tail, " \t\n\r")
+}
+
+// base64SafeRunThreshold is the length, in bytes, of a trailing run of
+// base64/hex alphabet characters above which Base64SafeBoundary refuses
+// to cut, on the assumption that a run that long is more likely to be an
+// encoded secret than coincidence.
+const base64SafeRunThreshold = 16
+
+// Base64SafeBoundary retreats a cut so it never lands inside a trailing
+// run of base64/hex alphabet bytes longer than base64SafeRunThreshold,
+// which would otherwise risk splitting an encoded secret across chunks.
+// If such a run fills all of tail it returns -1, and the cut stays where
+// it was, inside the run.
+func Base64SafeBoundary(tail []byte) int {
+	i := len(tail) - 1
+	for i >= 0 && isBase64Byte(tail[i]) {
+		i--
+	}
+	if len(tail)-1-i <= base64SafeRunThreshold {
+		return len(tail) - 1
+	}
+	return i
+}
+
+func isBase64Byte(b byte) bool {
+	switch {
+	case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9':
+		return true
+	case b == '+' || b == '/' || b == '=' || b == '_' || b == '-':
+		return true
+	default:
+		return false
+	}
+}
+
+// expansionWarmupBytes is the number of emitted bytes below which
+// WithMaxExpansionRatio doesn't evaluate the ratio yet. This keeps the
+// check from firing on small, legitimately high-ratio inputs (a few
+// bytes of boilerplate that happen to decompress to a few KiB).
+const expansionWarmupBytes = 1024 * 1024
+
+// ErrExpansionExceeded is the error a ChunkResult carries when a pipeline
+// configured with WithMaxExpansionRatio or WithMaxBytes detects that the
+// source is expanding faster, or producing more, than its configured
+// limits allow.
+var ErrExpansionExceeded = errors.New("chunk reader: expansion limit exceeded")
+
+// ExpansionTracker can optionally be implemented by a reader passed to a
+// ChunkReader so WithMaxExpansionRatio can compute a meaningful
+// emitted/consumed ratio. Decompressing readers (gzip, archive members,
+// etc.) should implement it to report the bytes they've read from their
+// own, still-compressed source; without it, the ratio falls back to
+// counting bytes read from reader itself, which only guards against
+// unbounded output, not decompression-bomb style amplification upstream.
+type ExpansionTracker interface {
+	BytesConsumed() int64
+}
+
+// WithMaxExpansionRatio bounds how much larger the bytes a chunk pipeline
+// emits downstream can grow relative to the bytes consumed from the
+// source, once at least expansionWarmupBytes have been emitted. It guards
+// against decompression bombs and similar amplification (see
+// CVE-2023-39326) turning a tiny input into unbounded downstream work.
+func WithMaxExpansionRatio(ratio float64) ConfigOption {
+	return func(c *chunkReaderConfig) { c.maxExpansionRatio = ratio }
+}
+
+// WithMaxBytes bounds the total number of bytes a chunk pipeline will
+// emit downstream before it gives up and reports ErrExpansionExceeded.
+func WithMaxBytes(n int64) ConfigOption {
+	return func(c *chunkReaderConfig) { c.maxBytes = n }
+}
+
+// countingReader is the ExpansionTracker used when the reader passed to a
+// ChunkReader doesn't implement one itself.
+type countingReader struct {
+	r        io.Reader
+	consumed int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.consumed, int64(n))
+	return n, err
+}
+
+func (c *countingReader) BytesConsumed() int64 {
+	return atomic.LoadInt64(&c.consumed)
+}
+
+// checkExpansionLimits returns ErrExpansionExceeded once emitted exceeds
+// config.maxBytes, or once emitted reaches expansionWarmupBytes and the
+// emitted/consumed ratio exceeds config.maxExpansionRatio. Either check is
+// skipped if its corresponding option wasn't set.
+func checkExpansionLimits(config *chunkReaderConfig, tracker ExpansionTracker, emitted int64) error {
+	if config.maxBytes > 0 && emitted > config.maxBytes {
+		return ErrExpansionExceeded
+	}
+
+	if config.maxExpansionRatio > 0 && tracker != nil && emitted >= expansionWarmupBytes {
+		if consumed := tracker.BytesConsumed(); consumed > 0 {
+			if float64(emitted)/float64(consumed) > config.maxExpansionRatio {
+				return ErrExpansionExceeded
+			}
+		}
+	}
+
+	return nil
+}
+
 // ChunkResult is the output unit of a ChunkReader,
 // it contains the data and error of a chunk.
 type ChunkResult struct {
 	data []byte
 	err  error
+
+	// offset is the absolute byte offset of data within the original
+	// source. It's only populated by readers with random access to the
+	// source, such as a ParallelChunkReader; the serial ChunkReader
+	// leaves it at 0.
+	offset int64
+
+	// streamID and sequence identify, for a ParallelChunkReader, which
+	// stream produced this result and its position within that stream,
+	// so consumers can reassemble chunks deterministically if needed.
+	streamID int
+	sequence int64
+
+	// release, if set, returns data's underlying buffer to the pool it
+	// came from. Consumers call Release once they're done with Bytes().
+	release func()
+}
+
+// Release returns this chunk's underlying buffer to its pool, if it came
+// from one. Callers must not use the slice returned by Bytes after
+// calling Release. It's safe to call on a zero-valued or unpooled
+// ChunkResult.
+func (cr ChunkResult) Release() {
+	if cr.release != nil {
+		cr.release()
+	}
 }
 
 // Bytes for a ChunkResult.
@@ -66,6 +278,24 @@ func (cr ChunkResult) Error() error {
 	return cr.err
 }
 
+// Offset is the absolute byte offset of this chunk within the original
+// source.
+func (cr ChunkResult) Offset() int64 {
+	return cr.offset
+}
+
+// StreamID is the index of the stream that produced this chunk, when read
+// by a ParallelChunkReader.
+func (cr ChunkResult) StreamID() int {
+	return cr.streamID
+}
+
+// Sequence is the monotonically increasing position of this chunk within
+// its stream, when read by a ParallelChunkReader.
+func (cr ChunkResult) Sequence() int64 {
+	return cr.sequence
+}
+
 // ChunkReader reads chunks from a reader and returns a channel of chunks and a channel of errors.
 // The channel of chunks is closed when the reader is closed.
 // This should be used whenever a large amount of data is read from a reader.
@@ -97,34 +327,193 @@ func applyOptions(opts []ConfigOption) *chunkReaderConfig {
 
 func createReaderFn(config *chunkReaderConfig) ChunkReader {
 	return func(ctx context.Context, reader io.Reader) <-chan ChunkResult {
+		if config.cdc.enabled {
+			return readInContentDefinedChunks(ctx, reader, config)
+		}
 		return readInChunks(ctx, reader, config)
 	}
 }
 
+// peekReader is the subset of *bufio.Reader that readInChunks relies on.
+// It's satisfied by *bufio.Reader itself and by *pushbackReader.
+type peekReader interface {
+	io.Reader
+	Peek(n int) ([]byte, error)
+}
+
+// pushbackReader wraps a peekReader with a buffer of bytes that were
+// already read but need to be served again, so a BoundaryFunc can retreat
+// a chunk's cut point without losing the bytes after it.
+type pushbackReader struct {
+	r       peekReader
+	pending []byte
+}
+
+func (p *pushbackReader) Read(buf []byte) (int, error) {
+	if len(p.pending) > 0 {
+		n := copy(buf, p.pending)
+		p.pending = p.pending[n:]
+		return n, nil
+	}
+	return p.r.Read(buf)
+}
+
+func (p *pushbackReader) Peek(n int) ([]byte, error) {
+	if n <= len(p.pending) {
+		return p.pending[:n], nil
+	}
+	extra, err := p.r.Peek(n - len(p.pending))
+	return append(append([]byte{}, p.pending...), extra...), err
+}
+
+// pushBack makes b the next bytes Read returns, ahead of anything already
+// buffered.
+func (p *pushbackReader) pushBack(b []byte) {
+	p.pending = append(b, p.pending...)
+}
+
+// applyBoundaryFunc runs config.boundaryFunc over the last boundaryLookback
+// bytes of chunkBytes and, if it finds a safe cut earlier than the end of
+// chunkBytes, pushes the bytes after that cut back into pr so they open
+// the next chunk. It returns the (possibly retreated) chunk length.
+func applyBoundaryFunc(pr *pushbackReader, config *chunkReaderConfig, chunkBytes []byte) int {
+	n := len(chunkBytes)
+	start := n - boundaryLookback
+	if start < 0 {
+		start = 0
+	}
+
+	cut := config.boundaryFunc(chunkBytes[start:n])
+	if cut < 0 {
+		return n
+	}
+
+	safePos := start + cut + 1
+	if safePos >= n {
+		return n
+	}
+
+	pushedBack := make([]byte, n-safePos)
+	copy(pushedBack, chunkBytes[safePos:n])
+	pr.pushBack(pushedBack)
+
+	return safePos
+}
+
+// chunkPoolKey identifies a sync.Pool of main chunk buffers by the sizes
+// that determine their capacity. Readers configured with the same
+// (chunkSize, peekSize) share a pool.
+type chunkPoolKey struct {
+	chunkSize int
+	peekSize  int
+}
+
+// chunkPools holds one *sync.Pool per distinct (chunkSize, peekSize)
+// combination seen by NewChunkReader, so that repeated scans using the
+// default sizes reuse the same buffers instead of allocating fresh ones
+// per ChunkReader instance.
+var chunkPools sync.Map // chunkPoolKey -> *sync.Pool
+
+// chunkBufferPool returns the shared pool of totalSize-capacity buffers
+// for the given chunkSize/peekSize, creating it on first use.
+func chunkBufferPool(chunkSize, peekSize, totalSize int) *sync.Pool {
+	key := chunkPoolKey{chunkSize: chunkSize, peekSize: peekSize}
+	if p, ok := chunkPools.Load(key); ok {
+		return p.(*sync.Pool)
+	}
+
+	pool := &sync.Pool{New: func() any { return make([]byte, totalSize) }}
+	actual, _ := chunkPools.LoadOrStore(key, pool)
+	return actual.(*sync.Pool)
+}
+
+// smallChunkPools holds one *sync.Pool per size bucket used by the small
+// chunk optimization and by readParallelStream's variable-sized reads,
+// keyed by the bucket's capacity.
+var smallChunkPools sync.Map // int (bucket size) -> *sync.Pool
+
+// smallChunkBufferPool returns the pool for the smallest power-of-two
+// bucket that can hold size bytes, creating it on first use. Bucketing
+// keeps the number of distinct pools small while still avoiding
+// mostly-empty buffers for callers whose requested size varies.
+func smallChunkBufferPool(size int) *sync.Pool {
+	bucket := 1
+	if size > 1 {
+		bucket = 1 << bits.Len(uint(size-1))
+	}
+
+	if p, ok := smallChunkPools.Load(bucket); ok {
+		return p.(*sync.Pool)
+	}
+
+	pool := &sync.Pool{New: func() any { return make([]byte, bucket) }}
+	actual, _ := smallChunkPools.LoadOrStore(bucket, pool)
+	return actual.(*sync.Pool)
+}
+
+// onceRelease returns a func that puts buf back into pool the first time
+// it's called, and is a no-op on every call after that. Without the
+// guard, a consumer calling ChunkResult.Release twice (e.g. once on a
+// success path and once in deferred cleanup) would Put the same buffer
+// twice, letting two later Get calls alias it while both are in use.
+func onceRelease(pool *sync.Pool, buf []byte) func() {
+	full := buf[:cap(buf)]
+	var once sync.Once
+	return func() {
+		once.Do(func() { pool.Put(full) })
+	}
+}
+
 func readInChunks(ctx context.Context, reader io.Reader, config *chunkReaderConfig) <-chan ChunkResult {
 	const channelSize = 64
-	chunkReader := bufio.NewReaderSize(reader, config.chunkSize)
+
+	tracker, _ := reader.(ExpansionTracker)
+	if tracker == nil && config.maxExpansionRatio > 0 {
+		counting := &countingReader{r: reader}
+		reader, tracker = counting, counting
+	}
+
+	var chunkReader peekReader = bufio.NewReaderSize(reader, config.chunkSize)
+	if config.boundaryFunc != nil {
+		chunkReader = &pushbackReader{r: chunkReader}
+	}
 	chunkResultChan := make(chan ChunkResult, channelSize)
 
+	mainPool := chunkBufferPool(config.chunkSize, config.peekSize, config.totalSize)
+
 	go func() {
 		defer close(chunkResultChan)
 
+		var emitted int64
+
 		for {
 			chunkRes := ChunkResult{}
-			chunkBytes := make([]byte, config.totalSize)
-			chunkBytes = chunkBytes[:config.chunkSize]
+			chunkBytes := mainPool.Get().([]byte)[:config.chunkSize]
+			releaseMain := onceRelease(mainPool, chunkBytes)
+
 			n, err := io.ReadFull(chunkReader, chunkBytes)
 			if n > 0 {
+				if config.boundaryFunc != nil && err == nil {
+					n = applyBoundaryFunc(chunkReader.(*pushbackReader), config, chunkBytes[:n])
+					chunkBytes = chunkBytes[:n]
+				}
+
 				peekData, _ := chunkReader.Peek(config.totalSize - n)
 				if n+len(peekData) < config.smallChunkThreshold {
-					optimizedChunk := make([]byte, n+len(peekData))
+					smallPool := smallChunkBufferPool(n + len(peekData))
+					optimizedChunk := smallPool.Get().([]byte)[:n+len(peekData)]
 					copy(optimizedChunk, chunkBytes[:n])
 					copy(optimizedChunk[n:], peekData)
 					chunkRes.data = optimizedChunk
+					chunkRes.release = onceRelease(smallPool, optimizedChunk)
+					releaseMain()
 				} else {
 					chunkBytes = append(chunkBytes[:n], peekData...)
 					chunkRes.data = chunkBytes
+					chunkRes.release = releaseMain
 				}
+			} else {
+				releaseMain()
 			}
 
 			// If there is an error other than EOF, or if we have read some bytes, send the chunk.
@@ -139,6 +528,18 @@ func readInChunks(ctx context.Context, reader io.Reader, config *chunkReaderConf
 				return
 			}
 
+			if n > 0 {
+				total := atomic.AddInt64(&emitted, int64(len(chunkRes.data)))
+				if expErr := checkExpansionLimits(config, tracker, total); expErr != nil {
+					chunkRes.err = expErr
+					select {
+					case <-ctx.Done():
+					case chunkResultChan <- chunkRes:
+					}
+					return
+				}
+			}
+
 			select {
 			case <-ctx.Done():
 				return
@@ -153,6 +554,427 @@ func readInChunks(ctx context.Context, reader io.Reader, config *chunkReaderConf
 	return chunkResultChan
 }
 
+const (
+	// defaultStreams is the default number of concurrent streams a
+	// ParallelChunkReader splits its source into.
+	defaultStreams = 4
+	// defaultMaxParallelChunkSize is the default ceiling a parallel
+	// stream's read size grows to.
+	defaultMaxParallelChunkSize = 8 * 1024 * 1024
+)
+
+// parallelChunkReaderConfig holds the settings for a ParallelChunkReader.
+type parallelChunkReaderConfig struct {
+	streams          int
+	initialChunkSize int
+	maxChunkSize     int
+}
+
+// ParallelConfigOption is a function that configures a ParallelChunkReader.
+type ParallelConfigOption func(*parallelChunkReaderConfig)
+
+// WithStreams sets the number of concurrent streams the source is
+// partitioned into.
+func WithStreams(n int) ParallelConfigOption {
+	return func(c *parallelChunkReaderConfig) { c.streams = n }
+}
+
+// WithInitialChunkSize sets the size of the first read each stream
+// performs. Subsequent reads within the same stream double in size, up to
+// the limit set by WithMaxChunkSize.
+func WithInitialChunkSize(size int) ParallelConfigOption {
+	return func(c *parallelChunkReaderConfig) { c.initialChunkSize = size }
+}
+
+// WithMaxChunkSize sets the ceiling a stream's read size grows to.
+func WithMaxChunkSize(size int) ParallelConfigOption {
+	return func(c *parallelChunkReaderConfig) { c.maxChunkSize = size }
+}
+
+// ParallelChunkReader reads chunks from a source that supports random
+// access and returns a channel of chunks. Unlike ChunkReader, it requires
+// knowing the total size of the source up front so it can be partitioned
+// into contiguous ranges that are read concurrently. Each ChunkResult is
+// tagged with its absolute Offset, plus a StreamID/Sequence pair, so
+// consumers can reassemble the source if they need data in order. The
+// channel is closed once every stream has reached the end of its range.
+//
+// This is intended for sources backed by io.ReaderAt/io.Seeker that are
+// large enough to benefit from concurrent reads: on-disk files under the
+// filesystem source, large archive members, S3 objects, etc. Non-seekable
+// io.Readers should keep using ChunkReader.
+type ParallelChunkReader func(ctx context.Context, source io.ReaderAt, size int64) <-chan ChunkResult
+
+// NewParallelChunkReader returns a ParallelChunkReader with the given
+// options.
+func NewParallelChunkReader(opts ...ParallelConfigOption) ParallelChunkReader {
+	config := applyParallelOptions(opts)
+	return func(ctx context.Context, source io.ReaderAt, size int64) <-chan ChunkResult {
+		return readInParallelChunks(ctx, source, size, config)
+	}
+}
+
+func applyParallelOptions(opts []ParallelConfigOption) *parallelChunkReaderConfig {
+	config := &parallelChunkReaderConfig{
+		streams:          defaultStreams,
+		initialChunkSize: ChunkSize,
+		maxChunkSize:     defaultMaxParallelChunkSize,
+	}
+
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	return config
+}
+
+func readInParallelChunks(ctx context.Context, source io.ReaderAt, size int64, config *parallelChunkReaderConfig) <-chan ChunkResult {
+	const channelSize = 64
+	chunkResultChan := make(chan ChunkResult, channelSize)
+
+	streams := config.streams
+	if streams < 1 {
+		streams = 1
+	}
+	if int64(streams) > size {
+		streams = int(size)
+	}
+	if streams < 1 {
+		streams = 1
+	}
+
+	rangeSize := size / int64(streams)
+
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		start := int64(i) * rangeSize
+		end := start + rangeSize
+		if i == streams-1 {
+			end = size
+		}
+
+		wg.Add(1)
+		go func(streamID int, start, end int64) {
+			defer wg.Done()
+			readParallelStream(ctx, source, streamID, start, end, config, chunkResultChan)
+		}(i, start, end)
+	}
+
+	go func() {
+		wg.Wait()
+		close(chunkResultChan)
+	}()
+
+	return chunkResultChan
+}
+
+// readParallelStream reads the [start, end) range of source, emitting
+// ChunkResults onto out. Successive reads within the stream double in
+// size, starting at config.initialChunkSize and capped at
+// config.maxChunkSize, so small ranges stay cheap while large ones
+// quickly ramp up to bandwidth-saturating reads.
+func readParallelStream(ctx context.Context, source io.ReaderAt, streamID int, start, end int64, config *parallelChunkReaderConfig, out chan<- ChunkResult) {
+	section := bufio.NewReaderSize(io.NewSectionReader(source, start, end-start), config.initialChunkSize)
+
+	offset := start
+	readSize := config.initialChunkSize
+	var seq int64
+
+	for offset < end {
+		if int64(readSize) > end-offset {
+			readSize = int(end - offset)
+		}
+
+		pool := smallChunkBufferPool(readSize)
+		buf := pool.Get().([]byte)[:readSize]
+		release := onceRelease(pool, buf)
+
+		n, err := io.ReadFull(section, buf)
+		if n > 0 {
+			res := ChunkResult{data: buf[:n], offset: offset, streamID: streamID, sequence: seq, release: release}
+			seq++
+			offset += int64(n)
+
+			select {
+			case <-ctx.Done():
+				return
+			case out <- res:
+			}
+		} else {
+			release()
+		}
+
+		if err != nil {
+			if isErrAndNotEOF(err) {
+				ctx.Logger().Error(err, "error reading parallel chunk stream")
+				select {
+				case <-ctx.Done():
+				case out <- ChunkResult{err: err, offset: offset, streamID: streamID, sequence: seq}:
+				}
+			}
+			return
+		}
+
+		if readSize < config.maxChunkSize {
+			readSize *= 2
+			if readSize > config.maxChunkSize {
+				readSize = config.maxChunkSize
+			}
+		}
+	}
+}
+
+// Ordered wraps a ParallelChunkReader so that its output is emitted in
+// ascending Offset order. It buffers every chunk in memory before
+// emitting any of them, so it trades the reader's low memory footprint
+// for a simple, deterministic order; callers that can reassemble chunks
+// themselves from Offset/StreamID/Sequence should prefer consuming the
+// unordered channel directly.
+func Ordered(reader ParallelChunkReader) ParallelChunkReader {
+	return func(ctx context.Context, source io.ReaderAt, size int64) <-chan ChunkResult {
+		in := reader(ctx, source, size)
+		out := make(chan ChunkResult, 64)
+
+		go func() {
+			defer close(out)
+
+			var results []ChunkResult
+			for res := range in {
+				results = append(results, res)
+			}
+
+			sort.Slice(results, func(i, j int) bool { return results[i].offset < results[j].offset })
+
+			for _, res := range results {
+				select {
+				case <-ctx.Done():
+					return
+				case out <- res:
+				}
+			}
+		}()
+
+		return out
+	}
+}
+
+const (
+	// rabinPolynomial is a fixed irreducible polynomial of degree 53 over
+	// GF(2), used as the modulus of the rolling fingerprint that drives
+	// content-defined chunking.
+	rabinPolynomial = 0x3DA3358B4DC173
+	// rabinPolDegree is the degree of rabinPolynomial.
+	rabinPolDegree = 53
+	// rabinPolShift isolates the top 8 bits of a fingerprint above
+	// rabinPolDegree, used to index into rabinTables.mod.
+	rabinPolShift = rabinPolDegree - 8
+	// rabinMask keeps a fingerprint within rabinPolDegree bits after each
+	// byte is folded in, so fp>>rabinPolShift stays within the bounds of
+	// rabinTables.mod/out.
+	rabinMask = (uint64(1) << rabinPolDegree) - 1
+	// cdcWindowSize is the size, in bytes, of the sliding window the
+	// rolling fingerprint is computed over.
+	cdcWindowSize = 64
+)
+
+// rabinTables holds the precomputed tables used to update the rolling
+// polynomial fingerprint one byte at a time: mod reduces the fingerprint
+// modulo rabinPolynomial as a new byte slides in, and out removes the
+// contribution of the byte sliding out of the trailing edge of the window.
+type rabinTables struct {
+	mod [256]uint64
+	out [256]uint64
+}
+
+// defaultRabinTables are the tables used by content-defined chunking.
+var defaultRabinTables = newRabinTables(rabinPolynomial)
+
+func newRabinTables(pol uint64) *rabinTables {
+	t := &rabinTables{}
+
+	for b := 0; b < 256; b++ {
+		t.mod[b] = polMod(uint64(b)<<rabinPolDegree, pol)
+	}
+
+	for b := 0; b < 256; b++ {
+		// A byte that's exactly cdcWindowSize positions old has had
+		// cdcWindowSize more x^8 shifts applied to it than it had the
+		// instant it was appended, so the loop runs cdcWindowSize times,
+		// not cdcWindowSize-1.
+		fp := appendByte(0, byte(b), t)
+		for i := 0; i < cdcWindowSize; i++ {
+			fp = appendByte(fp, 0, t)
+		}
+		t.out[b] = fp
+	}
+
+	return t
+}
+
+// appendByte folds b into fp the same way the rolling fingerprint is
+// updated in the hot loop, reducing modulo t's polynomial via t.mod. The
+// final mask keeps fp within rabinPolDegree bits: t.mod only adds the
+// remainder of the overflowed top byte, which lies below rabinPolDegree,
+// so it doesn't clear the bits that (fp<<8) shifted above it.
+func appendByte(fp uint64, b byte, t *rabinTables) uint64 {
+	return (((fp << 8) | uint64(b)) ^ t.mod[fp>>rabinPolShift]) & rabinMask
+}
+
+// polMod returns a mod pol, treating both as polynomials over GF(2).
+func polMod(a, pol uint64) uint64 {
+	degPol := polDeg(pol)
+	for d := polDeg(a); d >= degPol && a != 0; d = polDeg(a) {
+		a ^= pol << uint(d-degPol)
+	}
+	return a
+}
+
+// polDeg returns the degree of polynomial a, or -1 if a is zero.
+func polDeg(a uint64) int {
+	return bits.Len64(a) - 1
+}
+
+// cdcMask returns the bitmask checked against the low bits of the rolling
+// fingerprint to decide whether the current position is a chunk boundary.
+// It's sized so that boundaries occur, on average, every avgSize bytes.
+func cdcMask(avgSize int) uint64 {
+	bitsLen := bits.Len(uint(avgSize))
+	if bitsLen == 0 {
+		return 0
+	}
+	return uint64(1)<<uint(bitsLen-1) - 1
+}
+
+// readInContentDefinedChunks is the content-defined-chunking counterpart
+// of readInChunks: instead of cutting at a fixed offset, it slides a
+// Rabin fingerprint over the input and cuts whenever the fingerprint's low
+// bits are zero, bounded by cdc.minSize and cdc.maxSize. The PeekSize
+// semantic is preserved by peeking config.peekSize bytes past the chosen
+// boundary.
+func readInContentDefinedChunks(ctx context.Context, reader io.Reader, config *chunkReaderConfig) <-chan ChunkResult {
+	const channelSize = 64
+
+	tracker, _ := reader.(ExpansionTracker)
+	if tracker == nil && config.maxExpansionRatio > 0 {
+		counting := &countingReader{r: reader}
+		reader, tracker = counting, counting
+	}
+
+	bufReader := bufio.NewReaderSize(reader, config.cdc.maxSize+config.peekSize)
+	chunkResultChan := make(chan ChunkResult, channelSize)
+	mask := cdcMask(config.cdc.avgSize)
+
+	// mainPool buffers are sized to hold a full chunk plus its peek, same
+	// as readInChunks, so the peek can be appended in place below without
+	// growing past the pooled buffer's capacity.
+	mainPool := chunkBufferPool(config.cdc.maxSize, config.peekSize, config.cdc.maxSize+config.peekSize)
+
+	go func() {
+		defer close(chunkResultChan)
+
+		// rolling holds the fingerprint and window state across chunks:
+		// boundary decisions must depend only on the trailing window of
+		// content, never on where the previous chunk happened to end,
+		// or a single shifted byte upstream would cascade into a
+		// different boundary for every chunk that follows it.
+		rolling := &cdcRollingState{}
+		var emitted int64
+
+		for {
+			chunkRes := ChunkResult{}
+			chunkBuf := mainPool.Get().([]byte)[:0]
+			releaseMain := onceRelease(mainPool, chunkBuf)
+
+			chunk, err := nextCDCChunk(bufReader, config.cdc, mask, rolling, chunkBuf)
+			if len(chunk) > 0 {
+				peekData, _ := bufReader.Peek(config.peekSize)
+				n := len(chunk)
+
+				if n+len(peekData) < config.smallChunkThreshold {
+					smallPool := smallChunkBufferPool(n + len(peekData))
+					optimizedChunk := smallPool.Get().([]byte)[:n+len(peekData)]
+					copy(optimizedChunk, chunk)
+					copy(optimizedChunk[n:], peekData)
+					chunkRes.data = optimizedChunk
+					chunkRes.release = onceRelease(smallPool, optimizedChunk)
+					releaseMain()
+				} else {
+					chunkRes.data = append(chunk, peekData...)
+					chunkRes.release = releaseMain
+				}
+
+				if isErrAndNotEOF(err) {
+					ctx.Logger().Error(err, "error reading chunk")
+					chunkRes.err = err
+				}
+
+				total := atomic.AddInt64(&emitted, int64(len(chunkRes.data)))
+				if expErr := checkExpansionLimits(config, tracker, total); expErr != nil {
+					chunkRes.err = expErr
+					select {
+					case <-ctx.Done():
+					case chunkResultChan <- chunkRes:
+					}
+					return
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case chunkResultChan <- chunkRes:
+				}
+			} else {
+				releaseMain()
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return chunkResultChan
+}
+
+// cdcRollingState is the Rabin fingerprint and sliding window carried
+// across chunk boundaries by nextCDCChunk, so the rolling hash is
+// continuous over the whole input rather than restarting at each cut.
+type cdcRollingState struct {
+	window    [cdcWindowSize]byte
+	windowPos int
+	fp        uint64
+}
+
+// nextCDCChunk reads from r, byte by byte, until it finds a
+// content-defined boundary, hits cdc.maxSize, or reaches the end of r. It
+// appends to buf (which callers should pass in with 0 length and at least
+// cdc.maxSize capacity, typically from a pool, to avoid an allocation per
+// chunk) and returns the result, along with any error encountered (io.EOF
+// included). rolling carries the fingerprint state across calls; it must
+// not be reset between chunks.
+func nextCDCChunk(r *bufio.Reader, cdc cdcOptions, mask uint64, rolling *cdcRollingState, buf []byte) ([]byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return buf, err
+		}
+		buf = append(buf, b)
+
+		out := rolling.window[rolling.windowPos]
+		rolling.window[rolling.windowPos] = b
+		rolling.windowPos = (rolling.windowPos + 1) % cdcWindowSize
+
+		rolling.fp = appendByte(rolling.fp, b, defaultRabinTables)
+		rolling.fp ^= defaultRabinTables.out[out]
+
+		if len(buf) >= cdc.maxSize {
+			return buf, nil
+		}
+		if len(buf) >= cdc.minSize && rolling.fp&mask == 0 {
+			return buf, nil
+		}
+	}
+}
+
 // reportableErr checks whether the error is one we are interested in flagging.
 func isErrAndNotEOF(err error) bool {
 	if err == nil {
@@ -0,0 +1,481 @@
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/trufflesecurity/trufflehog/v3/pkg/context"
+)
+
+func TestContentDefinedChunking_ShiftStability(t *testing.T) {
+	const size = 1024 * 1024
+	orig := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(orig)
+
+	const insertAt = 100
+	const insertLen = 100
+	inserted := make([]byte, size+insertLen)
+	copy(inserted, orig[:insertAt])
+	rand.New(rand.NewSource(2)).Read(inserted[insertAt : insertAt+insertLen])
+	copy(inserted[insertAt+insertLen:], orig[insertAt:])
+
+	chunker := NewChunkReader(WithContentDefinedChunking(2*1024, 8*1024, 32*1024))
+
+	origChunks := collectChunks(t, chunker, orig)
+	insertedChunks := collectChunks(t, chunker, inserted)
+
+	if len(origChunks) < 10 {
+		t.Fatalf("expected at least 10 chunks from a %d byte input, got %d", size, len(origChunks))
+	}
+
+	origHashes := chunkHashes(origChunks)
+	insertedHashes := chunkHashes(insertedChunks)
+
+	common := longestCommonSuffixLen(origHashes, insertedHashes)
+	changed := len(origChunks) - common
+	if changed > 1 {
+		t.Fatalf("inserting %d bytes near the start changed %d of %d chunks; want only the first chunk to change", insertLen, changed, len(origChunks))
+	}
+	if changed == 0 {
+		t.Fatal("expected the insertion to change at least the first chunk")
+	}
+}
+
+func collectChunks(t *testing.T, reader ChunkReader, data []byte) [][]byte {
+	t.Helper()
+
+	var chunks [][]byte
+	for res := range reader(context.Background(), bytes.NewReader(data)) {
+		if err := res.Error(); err != nil {
+			t.Fatalf("unexpected chunk error: %v", err)
+		}
+		chunk := make([]byte, len(res.Bytes()))
+		copy(chunk, res.Bytes())
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+func chunkHashes(chunks [][]byte) []string {
+	hashes := make([]string, len(chunks))
+	for i, c := range chunks {
+		sum := sha256.Sum256(c)
+		hashes[i] = string(sum[:])
+	}
+	return hashes
+}
+
+// longestCommonSuffixLen returns the length of the longest common suffix
+// shared by a and b.
+func longestCommonSuffixLen(a, b []string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[len(a)-1-n] == b[len(b)-1-n] {
+		n++
+	}
+	return n
+}
+
+func TestParallelChunkReader_Ordered(t *testing.T) {
+	data := make([]byte, 200*1024)
+	rand.New(rand.NewSource(3)).Read(data)
+
+	reader := Ordered(NewParallelChunkReader(WithStreams(4), WithInitialChunkSize(4*1024), WithMaxChunkSize(16*1024)))
+
+	var reassembled []byte
+	lastOffset := int64(-1)
+	for res := range reader(context.Background(), bytes.NewReader(data), int64(len(data))) {
+		if err := res.Error(); err != nil {
+			t.Fatalf("unexpected chunk error: %v", err)
+		}
+		if res.Offset() < lastOffset {
+			t.Fatalf("chunk offset %d arrived out of order after %d", res.Offset(), lastOffset)
+		}
+		lastOffset = res.Offset()
+		reassembled = append(reassembled, res.Bytes()...)
+		res.Release()
+	}
+
+	if !bytes.Equal(reassembled, data) {
+		t.Fatalf("reassembled data does not match original: got %d bytes, want %d", len(reassembled), len(data))
+	}
+}
+
+func TestParallelChunkReader_OffsetAndSequencePerStream(t *testing.T) {
+	data := make([]byte, 100*1024)
+	rand.New(rand.NewSource(4)).Read(data)
+
+	reader := NewParallelChunkReader(WithStreams(3), WithInitialChunkSize(2*1024), WithMaxChunkSize(8*1024))
+
+	nextOffset := map[int]int64{}
+	nextSeq := map[int]int64{}
+	for res := range reader(context.Background(), bytes.NewReader(data), int64(len(data))) {
+		if err := res.Error(); err != nil {
+			t.Fatalf("unexpected chunk error: %v", err)
+		}
+
+		id := res.StreamID()
+		if want, ok := nextOffset[id]; ok && res.Offset() != want {
+			t.Fatalf("stream %d: got offset %d, want %d", id, res.Offset(), want)
+		}
+		if want := nextSeq[id]; res.Sequence() != want {
+			t.Fatalf("stream %d: got sequence %d, want %d", id, res.Sequence(), want)
+		}
+
+		nextOffset[id] = res.Offset() + int64(len(res.Bytes()))
+		nextSeq[id] = res.Sequence() + 1
+		res.Release()
+	}
+}
+
+func TestParallelChunkReader_ReadSizeDoublesUpToMax(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(5)).Read(data)
+
+	const initial = 1024
+	const max = 16 * 1024
+
+	reader := NewParallelChunkReader(WithStreams(1), WithInitialChunkSize(initial), WithMaxChunkSize(max))
+
+	var sizes []int
+	for res := range reader(context.Background(), bytes.NewReader(data), int64(len(data))) {
+		if err := res.Error(); err != nil {
+			t.Fatalf("unexpected chunk error: %v", err)
+		}
+		sizes = append(sizes, len(res.Bytes()))
+		res.Release()
+	}
+
+	if len(sizes) < 3 {
+		t.Fatalf("expected several chunks to observe doubling, got %d", len(sizes))
+	}
+	if sizes[0] != initial {
+		t.Fatalf("first chunk size = %d, want initial size %d", sizes[0], initial)
+	}
+	for i := 1; i < len(sizes)-1; i++ {
+		if sizes[i] > max {
+			t.Fatalf("chunk %d size %d exceeds max %d", i, sizes[i], max)
+		}
+		if sizes[i] < sizes[i-1] && sizes[i-1] < max {
+			t.Fatalf("chunk %d size %d is smaller than preceding chunk %d before reaching max", i, sizes[i], sizes[i-1])
+		}
+	}
+}
+
+func TestParallelChunkReader_StreamsGreaterThanSize(t *testing.T) {
+	data := []byte{1, 2, 3}
+
+	reader := NewParallelChunkReader(WithStreams(10))
+
+	var got []byte
+	for res := range reader(context.Background(), bytes.NewReader(data), int64(len(data))) {
+		if err := res.Error(); err != nil {
+			t.Fatalf("unexpected chunk error: %v", err)
+		}
+		got = append(got, res.Bytes()...)
+		res.Release()
+	}
+
+	if len(got) != len(data) {
+		t.Fatalf("got %d bytes across streams, want %d", len(got), len(data))
+	}
+}
+
+func TestLineBoundary(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want int
+	}{
+		{"newline in middle", "abc\ndef", 3},
+		{"trailing newline", "abc\n", 3},
+		{"no newline", "abcdef", -1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := LineBoundary([]byte(c.in)); got != c.want {
+				t.Errorf("LineBoundary(%q) = %d, want %d", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func TestWhitespaceBoundary(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want int
+	}{
+		{"space in middle", "abc def", 3},
+		{"tab in middle", "abc\tdef", 3},
+		{"no whitespace", "abcdef", -1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := WhitespaceBoundary([]byte(c.in)); got != c.want {
+				t.Errorf("WhitespaceBoundary(%q) = %d, want %d", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func TestBase64SafeBoundary(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want int
+	}{
+		{"short trailing run allowed", "hello " + strings.Repeat("A", 10), 15},
+		{"long trailing run retreats before it", "hello " + strings.Repeat("A", 20), 5},
+		{"run fills entire tail", strings.Repeat("A", 30), -1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := Base64SafeBoundary([]byte(c.in)); got != c.want {
+				t.Errorf("Base64SafeBoundary(%q) = %d, want %d", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func TestApplyBoundaryFunc_RetreatsAndPushesBackTail(t *testing.T) {
+	config := &chunkReaderConfig{boundaryFunc: LineBoundary}
+	chunkBytes := []byte("hello world\nmore data after newline")
+	pr := &pushbackReader{r: bufio.NewReader(bytes.NewReader([]byte("REST-OF-STREAM")))}
+
+	safePos := applyBoundaryFunc(pr, config, chunkBytes)
+
+	wantSafePos := bytes.LastIndexByte(chunkBytes, '\n') + 1
+	if safePos != wantSafePos {
+		t.Fatalf("safePos = %d, want %d", safePos, wantSafePos)
+	}
+
+	pushedBack := chunkBytes[safePos:]
+	replayed := make([]byte, len(pushedBack))
+	if _, err := io.ReadFull(pr, replayed); err != nil {
+		t.Fatalf("reading pushed-back bytes: %v", err)
+	}
+	if !bytes.Equal(replayed, pushedBack) {
+		t.Fatalf("replayed bytes = %q, want %q", replayed, pushedBack)
+	}
+
+	rest, err := io.ReadAll(pr)
+	if err != nil {
+		t.Fatalf("reading rest of stream: %v", err)
+	}
+	if string(rest) != "REST-OF-STREAM" {
+		t.Fatalf("rest of stream = %q, want %q", rest, "REST-OF-STREAM")
+	}
+}
+
+func TestApplyBoundaryFunc_NoSafePositionReturnsFullChunk(t *testing.T) {
+	config := &chunkReaderConfig{boundaryFunc: LineBoundary}
+	chunkBytes := []byte("no newline in this chunk at all")
+	pr := &pushbackReader{r: bufio.NewReader(bytes.NewReader(nil))}
+
+	n := applyBoundaryFunc(pr, config, chunkBytes)
+
+	if n != len(chunkBytes) {
+		t.Fatalf("n = %d, want %d (unchanged)", n, len(chunkBytes))
+	}
+	if len(pr.pending) != 0 {
+		t.Fatalf("expected no pushback, got %d pending bytes", len(pr.pending))
+	}
+}
+
+func TestApplyBoundaryFunc_CutAtEndNeedsNoPushback(t *testing.T) {
+	config := &chunkReaderConfig{boundaryFunc: LineBoundary}
+	chunkBytes := []byte("line one\nline two\n")
+	pr := &pushbackReader{r: bufio.NewReader(bytes.NewReader(nil))}
+
+	n := applyBoundaryFunc(pr, config, chunkBytes)
+
+	if n != len(chunkBytes) {
+		t.Fatalf("n = %d, want %d (cut already at end)", n, len(chunkBytes))
+	}
+	if len(pr.pending) != 0 {
+		t.Fatalf("expected no pushback, got %d pending bytes", len(pr.pending))
+	}
+}
+
+func TestCheckExpansionLimits(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  *chunkReaderConfig
+		tracker ExpansionTracker
+		emitted int64
+		wantErr bool
+	}{
+		{
+			name:    "max bytes not exceeded",
+			config:  &chunkReaderConfig{maxBytes: 100},
+			emitted: 100,
+			wantErr: false,
+		},
+		{
+			name:    "max bytes exceeded",
+			config:  &chunkReaderConfig{maxBytes: 100},
+			emitted: 101,
+			wantErr: true,
+		},
+		{
+			name:    "ratio ignored below warm-up threshold",
+			config:  &chunkReaderConfig{maxExpansionRatio: 0.0001},
+			tracker: constTracker(1),
+			emitted: expansionWarmupBytes - 1,
+			wantErr: false,
+		},
+		{
+			name:    "ratio exceeded at warm-up threshold",
+			config:  &chunkReaderConfig{maxExpansionRatio: 2},
+			tracker: constTracker(1),
+			emitted: expansionWarmupBytes,
+			wantErr: true,
+		},
+		{
+			name:    "ratio within limit at warm-up threshold",
+			config:  &chunkReaderConfig{maxExpansionRatio: 1000},
+			tracker: constTracker(expansionWarmupBytes),
+			emitted: expansionWarmupBytes,
+			wantErr: false,
+		},
+		{
+			name:    "no tracker skips ratio check",
+			config:  &chunkReaderConfig{maxExpansionRatio: 0.0001},
+			tracker: nil,
+			emitted: expansionWarmupBytes,
+			wantErr: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkExpansionLimits(c.config, c.tracker, c.emitted)
+			if c.wantErr && !errors.Is(err, ErrExpansionExceeded) {
+				t.Fatalf("checkExpansionLimits() = %v, want %v", err, ErrExpansionExceeded)
+			}
+			if !c.wantErr && err != nil {
+				t.Fatalf("checkExpansionLimits() = %v, want nil", err)
+			}
+		})
+	}
+}
+
+type constTracker int64
+
+func (c constTracker) BytesConsumed() int64 { return int64(c) }
+
+// bombReader emits emitLen bytes while reporting a constant, tiny
+// BytesConsumed, simulating a decompression bomb: a source that
+// expands trivial input into far more output.
+type bombReader struct {
+	emitLen int64
+}
+
+func (r *bombReader) Read(p []byte) (int, error) {
+	if r.emitLen <= 0 {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if int64(n) > r.emitLen {
+		n = int(r.emitLen)
+	}
+	r.emitLen -= int64(n)
+	return n, nil
+}
+
+func (r *bombReader) BytesConsumed() int64 { return 1 }
+
+func TestChunkReader_MaxExpansionRatio_FixedSize(t *testing.T) {
+	reader := NewChunkReader(WithMaxExpansionRatio(2))
+	src := &bombReader{emitLen: 4 * 1024 * 1024}
+
+	if err := drainForError(reader(context.Background(), src)); !errors.Is(err, ErrExpansionExceeded) {
+		t.Fatalf("got %v, want %v", err, ErrExpansionExceeded)
+	}
+}
+
+func TestChunkReader_MaxExpansionRatio_ContentDefinedChunking(t *testing.T) {
+	reader := NewChunkReader(WithContentDefinedChunking(2*1024, 8*1024, 32*1024), WithMaxExpansionRatio(2))
+	src := &bombReader{emitLen: 4 * 1024 * 1024}
+
+	if err := drainForError(reader(context.Background(), src)); !errors.Is(err, ErrExpansionExceeded) {
+		t.Fatalf("got %v, want %v", err, ErrExpansionExceeded)
+	}
+}
+
+func TestChunkReader_MaxExpansionRatio_NotTriggeredBelowWarmup(t *testing.T) {
+	// A quarter of the warm-up threshold, well clear of the overlap the
+	// peek preview adds to each chunk's reported size, so this stays
+	// below expansionWarmupBytes even accounting for that inflation.
+	reader := NewChunkReader(WithMaxExpansionRatio(0.0001))
+	src := &bombReader{emitLen: expansionWarmupBytes / 4}
+
+	if err := drainForError(reader(context.Background(), src)); err != nil {
+		t.Fatalf("unexpected error on well-formed input below warm-up threshold: %v", err)
+	}
+}
+
+func TestChunkReader_MaxBytes(t *testing.T) {
+	reader := NewChunkReader(WithMaxBytes(1000))
+	src := bytes.NewReader(make([]byte, 5000))
+
+	if err := drainForError(reader(context.Background(), src)); !errors.Is(err, ErrExpansionExceeded) {
+		t.Fatalf("got %v, want %v", err, ErrExpansionExceeded)
+	}
+}
+
+func drainForError(results <-chan ChunkResult) error {
+	var err error
+	for res := range results {
+		if res.Error() != nil {
+			err = res.Error()
+		}
+		res.Release()
+	}
+	return err
+}
+
+// benchReader streams n bytes of deterministic pseudo-random data without
+// holding the whole input in memory, so a "1GB input" benchmark doesn't
+// itself cost a 1GB allocation.
+type benchReader struct {
+	rng       *rand.Rand
+	remaining int64
+}
+
+func (r *benchReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, _ := r.rng.Read(p)
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+// BenchmarkReadInChunks reports allocations per op for the pooled-buffer
+// chunk reader on a synthetic 1GB input. Run with -benchmem for the alloc
+// counts and GODEBUG=gctrace=1 to observe GC pauses.
+func BenchmarkReadInChunks(b *testing.B) {
+	const size = 1 << 30
+
+	reader := NewChunkReader(WithChunkSize(64 * 1024))
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		src := &benchReader{rng: rand.New(rand.NewSource(1)), remaining: size}
+		for res := range reader(context.Background(), src) {
+			res.Release()
+		}
+	}
+}